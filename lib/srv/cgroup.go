@@ -0,0 +1,336 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package srv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cgroupParentDefault is where per-session accounting cgroups are created,
+// alongside (but independent of) any cgroup the BPF session watcher uses for
+// event correlation.
+const cgroupParentDefault = "/sys/fs/cgroup/teleport.slice"
+
+var (
+	execCPUSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "teleport_exec_cpu_seconds_total",
+			Help: "Total CPU time consumed by exec sessions.",
+		},
+		[]string{"login", "role"},
+	)
+	execMemoryPeakBytes = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "teleport_exec_memory_peak_bytes",
+			Help:    "Peak memory usage of exec sessions.",
+			Buckets: prometheus.ExponentialBuckets(1024*1024, 4, 10),
+		},
+		[]string{"login", "role"},
+	)
+	execOOMKillsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "teleport_exec_oom_kills_total",
+			Help: "Total number of exec sessions killed by the OOM killer.",
+		},
+		[]string{"login", "role"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(execCPUSeconds, execMemoryPeakBytes, execOOMKillsTotal)
+}
+
+// resourceLimits are the cgroup controller limits sourced from role options
+// for a session. An empty string leaves the corresponding controller
+// unconstrained.
+type resourceLimits struct {
+	// MemoryMax is written to memory.max, e.g. "512M" or "max".
+	MemoryMax string
+	// CPUMax is written to cpu.max, e.g. "100000 1000000" (quota period).
+	CPUMax string
+	// PIDsMax is written to pids.max.
+	PIDsMax string
+	// IOMax is written to io.max, e.g. "8:0 rbps=1048576".
+	IOMax string
+}
+
+// resourceUsage is what's read back from the cgroup after the session ends,
+// and is attached to the exec audit event as resource_usage fields.
+type resourceUsage struct {
+	MemoryPeakBytes uint64
+	CPUSeconds      float64
+	PIDsPeak        uint64
+	OOMKills        uint64
+}
+
+// cgroupAccountant places a session's re-exec'd child into a dedicated
+// cgroup, applies role-sourced limits, and reports usage once the session
+// ends. Implementations must tolerate Cleanup being called more than once,
+// and being called after limits failed to apply during creation.
+type cgroupAccountant interface {
+	// Path returns the cgroup directory the child should be launched into,
+	// or "" if this accountant is a no-op.
+	Path() string
+	// Usage reads the accumulated resource usage for the session so far.
+	Usage() (resourceUsage, error)
+	// Cleanup removes the cgroup. Safe to call multiple times and safe to
+	// call even if the cgroup was never successfully created.
+	Cleanup()
+}
+
+// newCgroupAccountant creates the per-session cgroup under parent (falling
+// back to cgroupParentDefault if parent is empty), preferring cgroup v2 and
+// falling back to cgroup v1, or a no-op accountant if neither is usable.
+// parent applies to cgroup v2 only; the v1 fallback always creates its
+// groups under /sys/fs/cgroup/{memory,pids}/teleport. The cgroup is created up front (before the caller ever calls Cmd.Start)
+// so Cleanup is always safe to defer regardless of whether the command
+// itself ever starts.
+func newCgroupAccountant(sessionID string, parent string, limits resourceLimits) cgroupAccountant {
+	if parent == "" {
+		parent = cgroupParentDefault
+	}
+
+	if isCgroupV2() {
+		a, err := newCgroupV2Accountant(sessionID, parent, limits)
+		if err == nil {
+			return a
+		}
+		log.Warnf("Unable to create cgroup v2 accounting slice, falling back: %v.", err)
+	}
+
+	if a, err := newCgroupV1Accountant(sessionID, limits); err == nil {
+		return a
+	} else {
+		log.Warnf("Unable to create cgroup v1 accounting group, disabling resource accounting: %v.", err)
+	}
+
+	return noopAccountant{}
+}
+
+// resolveResourceLimits reads the cgroup resource limits for a session off
+// its identity's role options, the same way resolveExecInterceptor reads
+// exec policy: per-role, not per-server.
+func resolveResourceLimits(ctx *ServerContext) resourceLimits {
+	if ctx.Identity.RoleSet == nil {
+		return resourceLimits{}
+	}
+	return ctx.Identity.RoleSet.ResourceLimits()
+}
+
+// roleNamesLabel joins a session's role names for use as a Prometheus label
+// value, the same way resolveResourceLimits reads role options: RoleSet is a
+// legitimate nil (e.g. no roles resolved yet), not a bug to guard against
+// defensively everywhere it's read.
+func roleNamesLabel(ctx *ServerContext) string {
+	if ctx.Identity.RoleSet == nil {
+		return ""
+	}
+	return strings.Join(ctx.Identity.RoleSet.RoleNames(), ",")
+}
+
+// isCgroupV2 reports whether the host is using the unified cgroup v2
+// hierarchy, indicated by the presence of cgroup.controllers at the root.
+func isCgroupV2() bool {
+	_, err := os.Stat("/sys/fs/cgroup/cgroup.controllers")
+	return err == nil
+}
+
+// noopAccountant is used when cgroups aren't usable on this host; Path
+// returns "" so the caller launches the child without any cgroup placement.
+type noopAccountant struct{}
+
+func (noopAccountant) Path() string                  { return "" }
+func (noopAccountant) Usage() (resourceUsage, error) { return resourceUsage{}, nil }
+func (noopAccountant) Cleanup()                      {}
+
+// cgroupV2Accountant implements cgroupAccountant against a cgroup v2 slice
+// at <parent>/session-<id>.scope.
+type cgroupV2Accountant struct {
+	dir string
+}
+
+func newCgroupV2Accountant(sessionID string, parent string, limits resourceLimits) (*cgroupV2Accountant, error) {
+	dir := filepath.Join(parent, fmt.Sprintf("session-%s.scope", sessionID))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	a := &cgroupV2Accountant{dir: dir}
+
+	for file, value := range map[string]string{
+		"memory.max": limits.MemoryMax,
+		"cpu.max":    limits.CPUMax,
+		"pids.max":   limits.PIDsMax,
+		"io.max":     limits.IOMax,
+	} {
+		if value == "" {
+			continue
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, file), []byte(value), 0644); err != nil {
+			a.Cleanup()
+			return nil, fmt.Errorf("writing %v: %w", file, err)
+		}
+	}
+
+	return a, nil
+}
+
+func (a *cgroupV2Accountant) Path() string {
+	return a.dir
+}
+
+func (a *cgroupV2Accountant) Usage() (resourceUsage, error) {
+	var usage resourceUsage
+
+	if peak, err := readCgroupUint64(filepath.Join(a.dir, "memory.peak")); err == nil {
+		usage.MemoryPeakBytes = peak
+	}
+	if peak, err := readCgroupUint64(filepath.Join(a.dir, "pids.peak")); err == nil {
+		usage.PIDsPeak = peak
+	}
+	if stat, err := ioutil.ReadFile(filepath.Join(a.dir, "cpu.stat")); err == nil {
+		usage.CPUSeconds = parseCPUStatUsageSeconds(string(stat))
+	}
+	if events, err := ioutil.ReadFile(filepath.Join(a.dir, "memory.events")); err == nil {
+		usage.OOMKills = parseMemoryEventsOOMKills(string(events))
+	}
+
+	return usage, nil
+}
+
+func (a *cgroupV2Accountant) Cleanup() {
+	if a.dir == "" {
+		return
+	}
+	if err := os.Remove(a.dir); err != nil && !os.IsNotExist(err) {
+		log.Debugf("Unable to remove cgroup %v: %v.", a.dir, err)
+	}
+}
+
+// readCgroupUint64 reads a single-line cgroup interface file, tolerating the
+// literal value "max" (treated as 0, i.e. "no peak recorded").
+func readCgroupUint64(path string) (uint64, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	s := strings.TrimSpace(string(data))
+	if s == "max" || s == "" {
+		return 0, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+// parseCPUStatUsageSeconds extracts usage_usec from a cgroup v2 cpu.stat
+// file and converts it to seconds.
+func parseCPUStatUsageSeconds(stat string) float64 {
+	for _, line := range strings.Split(stat, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			usec, err := strconv.ParseUint(fields[1], 10, 64)
+			if err == nil {
+				return float64(usec) / 1_000_000
+			}
+		}
+	}
+	return 0
+}
+
+// parseMemoryEventsOOMKills extracts the oom_kill counter from a cgroup v2
+// memory.events file.
+func parseMemoryEventsOOMKills(data string) uint64 {
+	for _, line := range strings.Split(data, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			n, err := strconv.ParseUint(fields[1], 10, 64)
+			if err == nil {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// cgroupV1Accountant is the degraded-but-useful fallback for hosts still on
+// the legacy per-controller cgroup v1 hierarchies. It only covers the
+// memory and pids controllers -- cgroup v1's cpu/io controllers don't map
+// cleanly onto the same limit strings, and aren't worth the complexity for
+// a fallback path.
+type cgroupV1Accountant struct {
+	memoryDir string
+	pidsDir   string
+}
+
+func newCgroupV1Accountant(sessionID string, limits resourceLimits) (*cgroupV1Accountant, error) {
+	a := &cgroupV1Accountant{
+		memoryDir: filepath.Join("/sys/fs/cgroup/memory/teleport", sessionID),
+		pidsDir:   filepath.Join("/sys/fs/cgroup/pids/teleport", sessionID),
+	}
+
+	if err := os.MkdirAll(a.memoryDir, 0755); err != nil {
+		return nil, err
+	}
+	if limits.MemoryMax != "" {
+		ioutil.WriteFile(filepath.Join(a.memoryDir, "memory.limit_in_bytes"), []byte(limits.MemoryMax), 0644)
+	}
+
+	if err := os.MkdirAll(a.pidsDir, 0755); err != nil {
+		a.Cleanup()
+		return nil, err
+	}
+	if limits.PIDsMax != "" {
+		ioutil.WriteFile(filepath.Join(a.pidsDir, "pids.max"), []byte(limits.PIDsMax), 0644)
+	}
+
+	return a, nil
+}
+
+// Path returns "" for cgroup v1: unlike v2, a process can't join multiple
+// v1 hierarchies via a single cgroup FD at clone time, so the caller falls
+// back to writing the PID into cgroup.procs after the process starts (see
+// localExec.Start).
+func (a *cgroupV1Accountant) Path() string {
+	return ""
+}
+
+// Join adds pid to both the memory and pids v1 hierarchies.
+func (a *cgroupV1Accountant) Join(pid int) {
+	ioutil.WriteFile(filepath.Join(a.memoryDir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+	ioutil.WriteFile(filepath.Join(a.pidsDir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
+
+func (a *cgroupV1Accountant) Usage() (resourceUsage, error) {
+	var usage resourceUsage
+	if peak, err := readCgroupUint64(filepath.Join(a.memoryDir, "memory.max_usage_in_bytes")); err == nil {
+		usage.MemoryPeakBytes = peak
+	}
+	return usage, nil
+}
+
+func (a *cgroupV1Accountant) Cleanup() {
+	os.Remove(a.memoryDir)
+	os.Remove(a.pidsDir)
+}
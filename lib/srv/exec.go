@@ -20,6 +20,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"os"
@@ -27,9 +28,11 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/crypto/ssh"
 
 	"github.com/gravitational/teleport"
@@ -103,6 +106,14 @@ type execCommand struct {
 	IsTestStub bool `json:"is_test_stub"`
 }
 
+// requestType enumerates the SSH request types that can result in a new
+// Exec being created. These mirror the request names defined by the SSH
+// connection protocol (RFC 4254).
+const (
+	execRequestType      = "exec"
+	subsystemRequestType = "subsystem"
+)
+
 // ExecResult is used internally to send the result of a command execution from
 // a goroutine to SSH request handler and back to the calling client
 type ExecResult struct {
@@ -111,6 +122,63 @@ type ExecResult struct {
 
 	// Code is return code that execution of the command resulted in.
 	Code int
+
+	// Signal is the name of the signal that terminated the command, if any
+	// (for example "terminated" or "killed"). Empty if the command ran to
+	// completion on its own.
+	Signal string
+}
+
+// MagicSessionErrorCode is a distinguished exit code for infrastructure-side
+// session errors: teardown triggered by Teleport itself (client disconnect,
+// server shutdown, unresponsive peer) rather than anything the executed
+// command returned. It's a high value that ordinary commands rarely return,
+// though it still lies inside the 0-255 range a real process exit status
+// can occupy.
+const MagicSessionErrorCode = 229
+
+// teardownGracePeriod is how long killOnCancel waits after sending SIGTERM
+// before escalating to SIGKILL.
+const teardownGracePeriod = 10 * time.Second
+
+// Termination reasons recorded on the audit event for an exec. "exited"
+// covers both success and a plain non-zero exit; the other three explain
+// why a command that didn't get to exit on its own was torn down.
+const (
+	terminationExited           = "exited"
+	terminationSignaled         = "signaled"
+	terminationClientDisconnect = "client_disconnect"
+	terminationServerShutdown   = "server_shutdown"
+)
+
+// signalFromError extracts the name of the signal that terminated a command,
+// if any, from the error returned by Wait.
+func signalFromError(err error) string {
+	switch v := err.(type) {
+	case *exec.ExitError:
+		if waitStatus, ok := v.Sys().(syscall.WaitStatus); ok && waitStatus.Signaled() {
+			return waitStatus.Signal().String()
+		}
+	case *ssh.ExitError:
+		return v.Signal()
+	}
+	return ""
+}
+
+// terminationReason classifies why an exec ended: a clean or non-zero exit,
+// a signal the child received independently of Teleport, or teardown that
+// Teleport itself triggered because the session context was canceled.
+func terminationReason(ctx *ServerContext, clientDisconnected bool, signal string) string {
+	if clientDisconnected {
+		if ctx.srv.Context() != nil && ctx.srv.Context().Err() != nil {
+			return terminationServerShutdown
+		}
+		return terminationClientDisconnect
+	}
+	if signal != "" {
+		return terminationSignaled
+	}
+	return terminationExited
 }
 
 // Exec executes an "exec" request.
@@ -135,8 +203,38 @@ type Exec interface {
 	PID() int
 }
 
-// NewExecRequest creates a new local or remote Exec.
-func NewExecRequest(ctx *ServerContext, command string) (Exec, error) {
+// NewExecRequest creates a new local or remote Exec. requestType distinguishes
+// a plain "exec" request from a "subsystem" request (e.g. "sftp"), since the
+// two require different handling even though both ultimately run a command
+// on the target host.
+func NewExecRequest(ctx *ServerContext, requestType string, command string) (Exec, error) {
+	isSFTP := requestType == subsystemRequestType && command == teleport.SFTPSubsystem
+
+	// Give the session's role-derived policy a chance to rewrite, deny, or
+	// flag the command before anything is ever re-exec'd. This runs ahead of
+	// the SFTP subsystem as well as the localExec/remoteExec split, so a
+	// role restricted to specific commands via ExecRules can't be bypassed
+	// by requesting the sftp subsystem instead of a regular exec.
+	rewritten, decision, err := resolveExecInterceptor(ctx).Inspect(ctx, command)
+	switch decision {
+	case DecisionDeny:
+		return &deniedExec{ctx: ctx, command: command, err: err}, nil
+	case DecisionLog:
+		ctx.Warningf("Exec policy flagged command for extra audit attention: %q", command)
+	}
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	command = rewritten
+
+	// The SFTP subsystem is only ever serviced locally: it runs an in-process file transfer server rather than a re-exec'd shell
+	// command, so it has no equivalent in remote (proxy-recording) mode.
+	if isSFTP {
+		return &sftpExec{
+			Ctx: ctx,
+		}, nil
+	}
+
 	// It doesn't matter what mode the cluster is in, if this is a Teleport node
 	// return a local *localExec.
 	if ctx.srv.Component() == teleport.ComponentNode {
@@ -179,6 +277,32 @@ type localExec struct {
 	// sessionContext holds the BPF session context used to lookup and interact
 	// with BPF sessions.
 	sessionContext *bpf.SessionContext
+
+	// teardownCancel stops the goroutine watching e.Ctx.Context() for
+	// cancellation once the command has exited on its own.
+	teardownCancel context.CancelFunc
+
+	// mu guards processExited and clientDisconnected below, which killOnCancel
+	// and Wait read and write from different goroutines.
+	mu sync.Mutex
+
+	// processExited records that Cmd.Wait has returned. killOnCancel checks
+	// this instead of e.Cmd.ProcessState directly, since ProcessState is
+	// written by Wait's goroutine with no synchronization a concurrent
+	// reader could rely on.
+	processExited bool
+
+	// clientDisconnected is set by the teardown watcher if it had to signal
+	// the child because e.Ctx.Context() was canceled mid-exec (the SSH
+	// client went away, e.g. its controlling process received SIGHUP),
+	// rather than the child exiting on its own.
+	clientDisconnected bool
+
+	// resourceAccountant places the re-exec'd child in a per-session cgroup
+	// and reports its resource usage once the session ends. It's created up
+	// front in Start, before Cmd.Start is ever called, so Cleanup is always
+	// safe to run even if the command never actually starts.
+	resourceAccountant cgroupAccountant
 }
 
 // GetCommand returns the command string.
@@ -206,12 +330,35 @@ func (e *localExec) Start(channel ssh.Channel) (*ExecResult, error) {
 		return nil, trace.Wrap(err)
 	}
 
+	// Create the per-session accounting cgroup before Start is ever called,
+	// so e.resourceAccountant.Cleanup() is always safe to run regardless of
+	// whether Cmd.Start succeeds. If the cgroup supports joining by FD
+	// (v2), request that the child be cloned directly into it; otherwise
+	// (v1, or cgroups unusable) the child is joined after it starts, or not
+	// accounted for at all.
+	sessionID := hex.EncodeToString(e.Ctx.Conn.SessionID())
+	e.resourceAccountant = newCgroupAccountant(sessionID, cgroupParentDefault, resolveResourceLimits(e.Ctx))
+	if cgroupPath := e.resourceAccountant.Path(); cgroupPath != "" {
+		if cgroupFile, err := os.Open(cgroupPath); err == nil {
+			if e.Cmd.SysProcAttr == nil {
+				e.Cmd.SysProcAttr = &syscall.SysProcAttr{}
+			}
+			e.Cmd.SysProcAttr.UseCgroupFD = true
+			e.Cmd.SysProcAttr.CgroupFD = int(cgroupFile.Fd())
+			defer cgroupFile.Close()
+		}
+	}
+
 	// Connect stdout and stderr to the channel so the user can interact with
 	// the command.
 	e.Cmd.Stderr = channel.Stderr()
 	e.Cmd.Stdout = channel
 
-	// Copy from the channel (client input) into stdin of the process.
+	// Copy from the channel (client input) into stdin of the process. This
+	// goroutine has no way to observe e.Ctx.Context() itself (io.Copy blocks
+	// on the channel read), so killOnCancel below is what actually reacts to
+	// cancellation; closing inputWriter here just unblocks Cmd.Wait() if the
+	// client closes its side first.
 	inputWriter, err := e.Cmd.StdinPipe()
 	if err != nil {
 		return nil, trace.Wrap(err)
@@ -225,9 +372,10 @@ func (e *localExec) Start(channel ssh.Channel) (*ExecResult, error) {
 	err = e.Cmd.Start()
 	if err != nil {
 		e.Ctx.Warningf("Local command %v failed to start: %v", e.GetCommand(), err)
+		e.resourceAccountant.Cleanup()
 
 		// Emit the result of execution to the audit log
-		emitExecAuditEvent(e.Ctx, e.GetCommand(), err)
+		emitExecAuditEvent(e.Ctx, e.GetCommand(), err, terminationExited, "", nil)
 
 		return &ExecResult{
 			Command: e.GetCommand(),
@@ -235,11 +383,67 @@ func (e *localExec) Start(channel ssh.Channel) (*ExecResult, error) {
 		}, trace.ConvertSystemError(err)
 	}
 
+	// Cgroup v1 (unlike v2) has no equivalent to CgroupFD, so join it after
+	// the fact instead of at clone time.
+	if v1, ok := e.resourceAccountant.(*cgroupV1Accountant); ok {
+		v1.Join(e.Cmd.Process.Pid)
+	}
+
+	// Watch for the session context being canceled (client disconnect or
+	// server shutdown) so a hung child doesn't pin this exec forever. The
+	// watcher stops itself once Wait observes the command has exited.
+	teardownCtx, teardownCancel := context.WithCancel(e.Ctx.Context())
+	e.teardownCancel = teardownCancel
+	go e.killOnCancel(teardownCtx)
+
 	e.Ctx.Infof("Started local command execution: %q", e.Command)
 
 	return nil, nil
 }
 
+// killOnCancel waits for ctx to be done and, if the command hasn't already
+// exited on its own, sends SIGTERM followed by SIGKILL on a grace deadline.
+// This is what makes e.Ctx.Context() cancellation (e.g. the SSH client's
+// controlling process receiving SIGHUP) actually tear down the child instead
+// of leaking it.
+func (e *localExec) killOnCancel(ctx context.Context) {
+	<-ctx.Done()
+
+	// If the command already exited, Wait canceled this context as part of
+	// normal cleanup -- there's nothing to signal.
+	e.mu.Lock()
+	if e.processExited {
+		e.mu.Unlock()
+		return
+	}
+	e.clientDisconnected = true
+	e.mu.Unlock()
+
+	proc := e.Cmd.Process
+	if proc == nil {
+		return
+	}
+
+	e.Ctx.Warningf("Session context canceled, sending SIGTERM to pid %v.", proc.Pid)
+	proc.Signal(syscall.SIGTERM)
+
+	select {
+	case <-time.After(teardownGracePeriod):
+	case <-e.Ctx.Context().Done():
+		// Parent context is already gone; fall through and wait out the
+		// same grace period below rather than looping forever.
+		<-time.After(teardownGracePeriod)
+	}
+
+	e.mu.Lock()
+	exited := e.processExited
+	e.mu.Unlock()
+	if !exited {
+		e.Ctx.Warningf("Pid %v did not exit after SIGTERM, sending SIGKILL.", proc.Pid)
+		proc.Signal(syscall.SIGKILL)
+	}
+}
+
 // Wait will block while the command executes.
 func (e *localExec) Wait() *ExecResult {
 	if e.Cmd.Process == nil {
@@ -248,18 +452,55 @@ func (e *localExec) Wait() *ExecResult {
 
 	// Block until the command is finished executing.
 	err := e.Cmd.Wait()
+
+	// Record that Cmd.Wait has returned before killOnCancel can observe
+	// e.Cmd.ProcessState, and snapshot clientDisconnected under the same
+	// lock it's written under.
+	e.mu.Lock()
+	e.processExited = true
+	clientDisconnected := e.clientDisconnected
+	e.mu.Unlock()
+
+	// Stop the teardown watcher now that the command has exited on its own;
+	// if it already fired (client_disconnect), this is a no-op.
+	if e.teardownCancel != nil {
+		e.teardownCancel()
+	}
+
+	signal := signalFromError(err)
+	reason := terminationReason(e.Ctx, clientDisconnected, signal)
+
 	if err != nil {
 		e.Ctx.Debugf("Local command failed: %v.", err)
 	} else {
 		e.Ctx.Debugf("Local command successfully executed.")
 	}
 
+	// Read back resource usage before the cgroup is cleaned up, and record
+	// it both on the audit event and as Prometheus metrics.
+	usage, usageErr := e.resourceAccountant.Usage()
+	e.resourceAccountant.Cleanup()
+	if usageErr != nil {
+		e.Ctx.Debugf("Unable to read resource usage: %v.", usageErr)
+	} else {
+		labels := prometheus.Labels{"login": e.Ctx.Identity.Login, "role": roleNamesLabel(e.Ctx)}
+		execCPUSeconds.With(labels).Add(usage.CPUSeconds)
+		execMemoryPeakBytes.With(labels).Observe(float64(usage.MemoryPeakBytes))
+		if usage.OOMKills > 0 {
+			execOOMKillsTotal.With(labels).Add(float64(usage.OOMKills))
+		}
+	}
+
 	// Emit the result of execution to the Audit Log.
-	emitExecAuditEvent(e.Ctx, e.GetCommand(), err)
+	emitExecAuditEvent(e.Ctx, e.GetCommand(), err, reason, signal, &usage)
 
 	execResult := &ExecResult{
 		Command: e.GetCommand(),
 		Code:    exitCode(err),
+		Signal:  signal,
+	}
+	if clientDisconnected {
+		execResult.Code = MagicSessionErrorCode
 	}
 
 	return execResult
@@ -344,6 +585,19 @@ type remoteExec struct {
 	command string
 	session *ssh.Session
 	ctx     *ServerContext
+
+	// monitorCancel stops the keepalive monitor started in Start. It's nil
+	// until Start succeeds.
+	monitorCancel context.CancelFunc
+
+	// mu guards unresponsive below, which onUnresponsivePeer sets from the
+	// monitorRemotePeer goroutine while Wait reads it from the caller's
+	// goroutine.
+	mu sync.Mutex
+
+	// unresponsive is set by the keepalive monitor if the remote peer
+	// stopped answering before Wait returned.
+	unresponsive bool
 }
 
 // GetCommand returns the command string.
@@ -378,25 +632,71 @@ func (r *remoteExec) Start(ch ssh.Channel) (*ExecResult, error) {
 		return nil, trace.Wrap(err)
 	}
 
+	// A hung network path to the downstream node (proxy-recording mode
+	// forwards to it over r.ctx.RemoteClient) would otherwise pin this exec
+	// indefinitely: session.Wait blocks forever and nothing ever releases
+	// the SSH channel or records what happened. Probe the peer for as long
+	// as the session runs so a dead connection gets torn down instead.
+	monitorCtx, cancel := context.WithCancel(context.Background())
+	r.monitorCancel = cancel
+	go monitorRemotePeer(monitorCtx, r.ctx.RemoteClient, r.onUnresponsivePeer)
+
 	return nil, nil
 }
 
+// onUnresponsivePeer is invoked by the keepalive monitor when the remote
+// peer stops answering. It closes the session and the underlying
+// connection so session.Wait unblocks instead of hanging forever.
+func (r *remoteExec) onUnresponsivePeer() {
+	r.mu.Lock()
+	r.unresponsive = true
+	r.mu.Unlock()
+	r.ctx.Warningf("Remote peer %v unresponsive, terminating exec session.", r.ctx.RemoteClient.RemoteAddr())
+	r.session.Close()
+	r.ctx.RemoteClient.Close()
+}
+
 // Wait will block while the command executes.
 func (r *remoteExec) Wait() *ExecResult {
 	// Block until the command is finished executing.
 	err := r.session.Wait()
+	if r.monitorCancel != nil {
+		r.monitorCancel()
+	}
+
+	r.mu.Lock()
+	unresponsive := r.unresponsive
+	r.mu.Unlock()
+
+	// If the keepalive monitor tore down the session because the remote
+	// peer stopped responding, report that distinctly rather than as a
+	// generic failure.
+	if unresponsive {
+		err = remotePeerUnresponsiveError{}
+	}
+
 	if err != nil {
 		r.ctx.Debugf("Remote command failed: %v.", err)
 	} else {
 		r.ctx.Debugf("Remote command successfully executed.")
 	}
 
+	signal := signalFromError(err)
+	reason := terminationExited
+	switch {
+	case unresponsive:
+		reason = terminationClientDisconnect
+	case signal != "":
+		reason = terminationSignaled
+	}
+
 	// Emit the result of execution to the Audit Log.
-	emitExecAuditEvent(r.ctx, r.command, err)
+	emitExecAuditEvent(r.ctx, r.command, err, reason, signal, nil)
 
 	return &ExecResult{
 		Command: r.GetCommand(),
 		Code:    exitCode(err),
+		Signal:  signal,
 	}
 }
 
@@ -410,7 +710,14 @@ func (r *remoteExec) PID() int {
 	return 0
 }
 
-func emitExecAuditEvent(ctx *ServerContext, cmd string, execErr error) {
+// emitExecAuditEvent reports the result of an exec to the audit logger.
+// reason and signal record why and how the command ended -- see the
+// terminationXxx constants and signalFromError -- so a signaled or
+// infrastructure-terminated session can be told apart from a normal exit
+// without parsing the error string. usage is the cgroup resource usage for
+// the session, or nil if none was collected (e.g. for remoteExec, which has
+// no local cgroup to read from).
+func emitExecAuditEvent(ctx *ServerContext, cmd string, execErr error, reason string, signal string, usage *resourceUsage) {
 	// Report the result of this exec event to the audit logger.
 	auditLog := ctx.srv.GetAuditLog()
 	if auditLog == nil {
@@ -433,22 +740,35 @@ func emitExecAuditEvent(ctx *ServerContext, cmd string, execErr error) {
 		//
 		// https://bugs.debian.org/cgi-bin/bugreport.cgi?bug=327019
 		// https://bugzilla.mindrot.org/show_bug.cgi?id=1998
-		events.ExecEventCode:    strconv.Itoa(exitCode(execErr)),
-		events.ExecEventCommand: cmd,
+		events.ExecEventCode:     strconv.Itoa(exitCode(execErr)),
+		events.ExecEventCommand:  cmd,
+		events.TerminationReason: reason,
 	}
 	if execErr != nil {
 		fields[events.ExecEventError] = execErr.Error()
 	}
+	if signal != "" {
+		fields[events.ExecEventSignal] = signal
+	}
+	if usage != nil {
+		fields[events.ExecResourceUsageMemoryPeak] = usage.MemoryPeakBytes
+		fields[events.ExecResourceUsageCPUSeconds] = usage.CPUSeconds
+		fields[events.ExecResourceUsagePIDsPeak] = usage.PIDsPeak
+		fields[events.ExecResourceUsageOOMKills] = usage.OOMKills
+	}
 
-	// Parse the exec command to find out if it was SCP or not.
-	path, action, isSCP, err := parseSecureCopy(cmd)
+	// Parse the exec command to find out if it was a file transfer (SCP or
+	// SFTP) or a regular command.
+	path, action, kind, err := fileTransferAuditor(cmd)
 	if err != nil {
 		log.Warnf("Unable to emit audit event: %v.", err)
 		return
 	}
 
-	// Update appropriate fields based off if the request was SCP or not.
-	if isSCP {
+	// Update appropriate fields based off what kind of file transfer (if any)
+	// the request was.
+	switch kind {
+	case secureCopyTransfer:
 		fields[events.SCPPath] = path
 		fields[events.SCPAction] = action
 		switch action {
@@ -465,7 +785,17 @@ func emitExecAuditEvent(ctx *ServerContext, cmd string, execErr error) {
 				event = events.SCPDownload
 			}
 		}
-	} else {
+	case sftpTransfer:
+		// Per-operation SFTP.Open/Write/Rename/Remove events are emitted
+		// directly by sftpExec as the in-process SFTP server services each
+		// client request. This event just records that the subsystem ran
+		// and how it exited, same as a regular exec.
+		if execErr != nil {
+			event = events.SFTPSessionFailure
+		} else {
+			event = events.SFTPSession
+		}
+	default:
 		if execErr != nil {
 			event = events.ExecFailure
 		} else {
@@ -532,11 +862,33 @@ func getDefaultEnvPath(uid string, loginDefsPath string) string {
 	return envPath
 }
 
-// parseSecureCopy will parse a command and return if it's secure copy or not.
-func parseSecureCopy(path string) (string, string, bool, error) {
+// fileTransferKind identifies which (if any) file transfer protocol a
+// command corresponds to.
+type fileTransferKind int
+
+const (
+	// noFileTransfer means the command is a regular exec/shell command.
+	noFileTransfer fileTransferKind = iota
+	// secureCopyTransfer means the command is a re-exec'd "teleport scp".
+	secureCopyTransfer
+	// sftpTransfer means the command is the "sftp" subsystem.
+	sftpTransfer
+)
+
+// fileTransferAuditor parses a command and determines whether it represents
+// a file transfer (SCP or SFTP) so callers can attach the right fields to
+// the audit event. It generalizes the original SCP-only parser so both
+// transfer protocols can share the same audit pipeline.
+func fileTransferAuditor(path string) (string, string, fileTransferKind, error) {
 	parts := strings.Fields(path)
 	if len(parts) == 0 {
-		return "", "", false, trace.BadParameter("no executable found")
+		return "", "", noFileTransfer, trace.BadParameter("no executable found")
+	}
+
+	// The SFTP subsystem has no path or action to report here; per-operation
+	// events carry the path instead.
+	if parts[0] == teleport.SFTPSubsystem {
+		return "", "", sftpTransfer, nil
 	}
 
 	// Look for the -t flag, it indicates that an upload occurred. The other
@@ -549,18 +901,25 @@ func parseSecureCopy(path string) (string, string, bool, error) {
 	// Exract the name of the Teleport executable on disk.
 	teleportPath, err := os.Executable()
 	if err != nil {
-		return "", "", false, trace.Wrap(err)
+		return "", "", noFileTransfer, trace.Wrap(err)
 	}
 	_, teleportBinary := filepath.Split(teleportPath)
 
 	// Extract the name of the executable that was run. The command was secure
 	// copy if the executable was "scp" or "teleport".
 	_, executable := filepath.Split(parts[0])
+
+	// A re-exec'd "teleport sftp" child (see sftpExec.Start) is the SFTP
+	// subsystem too.
+	if executable == teleportBinary && len(parts) > 1 && parts[1] == teleport.SFTPSubsystem {
+		return "", "", sftpTransfer, nil
+	}
+
 	switch executable {
 	case teleport.SCP, teleportBinary:
-		return parts[len(parts)-1], action, true, nil
+		return parts[len(parts)-1], action, secureCopyTransfer, nil
 	default:
-		return "", "", false, nil
+		return "", "", noFileTransfer, nil
 	}
 }
 
@@ -582,6 +941,11 @@ func exitCode(err error) int {
 	// Remote execution.
 	case *ssh.ExitError:
 		return v.ExitStatus()
+	// The remote peer stopped answering keepalive probes; distinguish this
+	// from a generic failure so operators can tell the two apart in audit
+	// logs without having to read error text.
+	case remotePeerUnresponsiveError:
+		return MagicSessionErrorCode
 	// An error occurred, but the type is unknown, return a generic 255 code.
 	default:
 		log.Debugf("Unknown error returned when executing command: %T: %v.", err, err)
@@ -0,0 +1,110 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package srv
+
+import (
+	"testing"
+
+	"github.com/gravitational/teleport/lib/events"
+)
+
+func TestFileTransferAuditor(t *testing.T) {
+	tests := []struct {
+		desc     string
+		cmd      string
+		wantKind fileTransferKind
+		wantPath string
+		wantAct  string
+	}{
+		{
+			desc:     "sftp subsystem",
+			cmd:      "sftp",
+			wantKind: sftpTransfer,
+		},
+		{
+			desc:     "scp download",
+			cmd:      "scp -f /home/bob/report.txt",
+			wantKind: secureCopyTransfer,
+			wantPath: "/home/bob/report.txt",
+			wantAct:  events.SCPActionDownload,
+		},
+		{
+			desc:     "scp upload",
+			cmd:      "scp -t /home/bob/report.txt",
+			wantKind: secureCopyTransfer,
+			wantPath: "/home/bob/report.txt",
+			wantAct:  events.SCPActionUpload,
+		},
+		{
+			desc:     "regular command",
+			cmd:      "ls -la /home/bob",
+			wantKind: noFileTransfer,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			path, action, kind, err := fileTransferAuditor(tt.cmd)
+			if err != nil {
+				t.Fatalf("fileTransferAuditor(%q) returned error: %v", tt.cmd, err)
+			}
+			if kind != tt.wantKind {
+				t.Errorf("fileTransferAuditor(%q) kind = %v, want %v", tt.cmd, kind, tt.wantKind)
+			}
+			if kind == secureCopyTransfer {
+				if path != tt.wantPath {
+					t.Errorf("fileTransferAuditor(%q) path = %q, want %q", tt.cmd, path, tt.wantPath)
+				}
+				if action != tt.wantAct {
+					t.Errorf("fileTransferAuditor(%q) action = %q, want %q", tt.cmd, action, tt.wantAct)
+				}
+			}
+		})
+	}
+}
+
+func TestFileTransferAuditorEmptyCommand(t *testing.T) {
+	_, _, _, err := fileTransferAuditor("")
+	if err == nil {
+		t.Fatal("fileTransferAuditor(\"\") expected an error, got nil")
+	}
+}
+
+// TestTerminationReason covers the branches that don't depend on
+// ctx.srv: whether a command that ran to completion on its own was
+// signaled or exited cleanly. The clientDisconnected branches need a
+// *ServerContext wired to a running server to exercise and aren't
+// covered here.
+func TestTerminationReason(t *testing.T) {
+	tests := []struct {
+		desc   string
+		signal string
+		want   string
+	}{
+		{desc: "clean exit", signal: "", want: terminationExited},
+		{desc: "signaled", signal: "SIGKILL", want: terminationSignaled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got := terminationReason(nil, false, tt.signal)
+			if got != tt.want {
+				t.Errorf("terminationReason(nil, false, %q) = %q, want %q", tt.signal, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package srv
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// keepAliveInterval is how often a "keepalive@openssh.com" global
+	// request is sent to probe a remote SSH peer for liveness.
+	keepAliveInterval = 5 * time.Second
+
+	// keepAliveMaxFailures is the number of consecutive keepalive failures
+	// tolerated before the peer is considered unresponsive.
+	keepAliveMaxFailures = 3
+
+	// keepAliveDeadline is the maximum amount of time a peer is given to
+	// answer keepalive requests before being considered unresponsive,
+	// regardless of how many individual probes have failed.
+	keepAliveDeadline = 2 * time.Minute
+
+	// keepAliveProbeTimeout bounds a single keepalive probe. A dead TCP path
+	// never returns a read/write error, it just blocks forever, so
+	// SendRequest needs its own timeout -- otherwise a single stuck probe
+	// would wedge the detector instead of counting as a failure.
+	keepAliveProbeTimeout = keepAliveInterval
+
+	// keepAliveRequestType is the global request name OpenSSH uses for
+	// keepalive probes. It's never actually handled by the peer (that's the
+	// point), so any reply -- including "request type unknown" -- proves the
+	// peer is still alive.
+	keepAliveRequestType = "keepalive@openssh.com"
+)
+
+// remotePeerUnresponsiveError indicates that a remote SSH peer stopped
+// answering keepalive probes before the session completed. exitCode
+// recognizes this type and maps it to MagicSessionErrorCode so the audit
+// log can distinguish a dead peer from a generic failure.
+type remotePeerUnresponsiveError struct{}
+
+func (remotePeerUnresponsiveError) Error() string {
+	return "remote_peer_unresponsive"
+}
+
+// monitorRemotePeer periodically sends keepalive global requests on client
+// and calls onUnresponsive if keepAliveMaxFailures consecutive probes fail,
+// or if keepAliveDeadline elapses without a successful reply. It returns
+// once ctx is canceled or a failure is reported. This is shared by
+// remoteExec and is equally usable from a shell/PTY session in this
+// package: anything holding a *ssh.Client to a downstream node should run
+// it for the life of the session.
+func monitorRemotePeer(ctx context.Context, client *ssh.Client, onUnresponsive func()) {
+	ticker := time.NewTicker(keepAliveInterval)
+	defer ticker.Stop()
+
+	deadline := time.NewTimer(keepAliveDeadline)
+	defer deadline.Stop()
+
+	var failures int
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline.C:
+			log.Warnf("Remote peer unresponsive after %v, giving up.", keepAliveDeadline)
+			onUnresponsive()
+			return
+		case <-ticker.C:
+			ok := probeRemotePeer(ctx, client)
+			if ctx.Err() != nil {
+				// The session ended while the probe was in flight; let the
+				// ctx.Done() case above handle returning.
+				continue
+			}
+			if !ok {
+				failures++
+				log.Debugf("Keepalive probe %v of %v failed or timed out.", failures, keepAliveMaxFailures)
+				if failures >= keepAliveMaxFailures {
+					onUnresponsive()
+					return
+				}
+				continue
+			}
+			failures = 0
+			// The peer just proved it's alive, so push the deadline back out
+			// instead of tearing down a healthy session once keepAliveDeadline
+			// has elapsed in total.
+			if !deadline.Stop() {
+				<-deadline.C
+			}
+			deadline.Reset(keepAliveDeadline)
+		}
+	}
+}
+
+// probeRemotePeer sends a single keepalive request and reports whether it
+// succeeded within keepAliveProbeTimeout (or ctx was canceled first). The
+// request runs in its own goroutine so a dead TCP path that never returns an
+// error -- it just blocks -- can't wedge the caller; that goroutine is left
+// to exit on its own once the connection is eventually torn down.
+func probeRemotePeer(ctx context.Context, client *ssh.Client) bool {
+	probeCtx, cancel := context.WithTimeout(ctx, keepAliveProbeTimeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest(keepAliveRequestType, true, nil)
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		return err == nil
+	case <-probeCtx.Done():
+		return false
+	}
+}
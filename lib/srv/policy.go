@@ -0,0 +1,235 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package srv
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+
+	"github.com/google/shlex"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gravitational/teleport"
+	"github.com/gravitational/teleport/lib/events"
+
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+)
+
+// Decision is the outcome of running a command through an ExecInterceptor.
+type Decision int
+
+const (
+	// DecisionAllow lets the command run unchanged.
+	DecisionAllow Decision = iota
+	// DecisionDeny refuses to run the command at all.
+	DecisionDeny
+	// DecisionLog allows the command but flags it for extra audit attention.
+	DecisionLog
+)
+
+// ExecInterceptor inspects a command before it's ever handed to Cmd.Start,
+// and decides whether (and how) it may run. It's resolved per-session from
+// the identity's role options, so different roles can carry different
+// policy without NewExecRequest or localExec needing to know about roles at
+// all.
+type ExecInterceptor interface {
+	// Inspect looks at cmd and returns a possibly-rewritten command line
+	// along with a decision. The decision, not err, is authoritative: a
+	// DecisionDeny should always be treated as a deny even when err is nil.
+	// When a deny has a reason worth recording (e.g. the rule ID that
+	// matched), Inspect returns it as err so it can be carried through to
+	// the audit event without a third return value.
+	Inspect(ctx *ServerContext, cmd string) (rewritten string, decision Decision, err error)
+}
+
+// ExecRule is a single allow/deny entry in a role's exec policy.
+type ExecRule struct {
+	// ID identifies the rule for the audit log, e.g. "git-only".
+	ID string
+
+	// Allow is a glob matched against the command's argv[0] (after
+	// resolving the final path element, the way transformSecureCopy already
+	// does for scp). An empty Allow matches nothing.
+	Allow string
+
+	// Deny is a glob matched against argv[0], checked before Allow so a
+	// deny always wins a tie. An empty Deny matches nothing.
+	Deny string
+
+	// ArgvRegex, if set, is matched against the full command line in
+	// addition to Allow/Deny. A match denies the command (for example, any
+	// invocation containing "rm -rf /"); it never allows one.
+	ArgvRegex *regexp.Regexp
+}
+
+// execDeniedError explains why the built-in interceptor denied a command.
+// It carries the rule ID so callers can attach it to the ExecDenied audit
+// event without re-deriving it.
+type execDeniedError struct {
+	ruleID string
+	reason string
+}
+
+func (e *execDeniedError) Error() string {
+	if e.ruleID != "" {
+		return fmt.Sprintf("command denied by rule %q: %s", e.ruleID, e.reason)
+	}
+	return e.reason
+}
+
+// globInterceptor is the built-in ExecInterceptor. It tokenizes the command
+// line with a shell-aware lexer (so quoting and escaping are respected
+// instead of a naive strings.Fields split) and matches the result against a
+// role's ExecRules.
+type globInterceptor struct {
+	rules []ExecRule
+}
+
+// Inspect implements ExecInterceptor.
+func (g *globInterceptor) Inspect(ctx *ServerContext, cmd string) (string, Decision, error) {
+	if len(g.rules) == 0 {
+		return cmd, DecisionAllow, nil
+	}
+
+	argv, err := shlex.Split(cmd)
+	if err != nil || len(argv) == 0 {
+		// An unparsable command line can't be matched against any rule; err
+		// on the side of denying rather than silently letting it through.
+		return cmd, DecisionDeny, &execDeniedError{reason: "unable to parse command"}
+	}
+	program := filepath.Base(argv[0])
+
+	for _, rule := range g.rules {
+		if rule.Deny != "" {
+			if ok, _ := filepath.Match(rule.Deny, program); ok {
+				return cmd, DecisionDeny, &execDeniedError{ruleID: rule.ID, reason: "matched deny rule"}
+			}
+		}
+		if rule.ArgvRegex != nil && rule.ArgvRegex.MatchString(cmd) {
+			return cmd, DecisionDeny, &execDeniedError{ruleID: rule.ID, reason: "matched deny pattern"}
+		}
+	}
+
+	// Only an explicit Allow rule narrows the policy to an allowlist. A role
+	// that defines nothing but Deny/ArgvRegex rules (e.g. "block rm -rf /")
+	// is still default-allow for everything that isn't denied above.
+	hasAllowRule := false
+	for _, rule := range g.rules {
+		if rule.Allow == "" {
+			continue
+		}
+		hasAllowRule = true
+		if ok, _ := filepath.Match(rule.Allow, program); ok {
+			return cmd, DecisionAllow, nil
+		}
+	}
+	if !hasAllowRule {
+		return cmd, DecisionAllow, nil
+	}
+
+	return cmd, DecisionDeny, &execDeniedError{reason: "no allow rule matched"}
+}
+
+// resolveExecInterceptor builds the ExecInterceptor for a session from its
+// identity's role options, mirroring how other per-session policy (session
+// recording, PAM) is already read off the role set elsewhere in this
+// package.
+func resolveExecInterceptor(ctx *ServerContext) ExecInterceptor {
+	if ctx.Identity.RoleSet == nil {
+		return &globInterceptor{}
+	}
+	return &globInterceptor{rules: ctx.Identity.RoleSet.ExecRules()}
+}
+
+// deniedExec is the Exec returned by NewExecRequest when the interceptor
+// denies a command. It never builds an *exec.Cmd, so Cmd.Start is never
+// called; Start just emits the ExecDenied audit event and reports a
+// non-zero exit to the client.
+type deniedExec struct {
+	ctx     *ServerContext
+	command string
+	err     error
+}
+
+// GetCommand returns the command string.
+func (d *deniedExec) GetCommand() string {
+	return d.command
+}
+
+// SetCommand sets the command string.
+func (d *deniedExec) SetCommand(command string) {
+	d.command = command
+}
+
+// Start emits the ExecDenied audit event and returns a non-zero exit,
+// without ever starting a process.
+func (d *deniedExec) Start(channel ssh.Channel) (*ExecResult, error) {
+	emitExecDeniedAuditEvent(d.ctx, d.command, d.err)
+	msg := "command denied by exec policy"
+	if d.err != nil {
+		msg = d.err.Error()
+	}
+	return &ExecResult{
+		Command: d.command,
+		Code:    teleport.RemoteCommandFailure,
+	}, trace.AccessDenied(msg)
+}
+
+// Wait returns immediately; deniedExec never has anything running.
+func (d *deniedExec) Wait() *ExecResult {
+	return &ExecResult{
+		Command: d.command,
+		Code:    teleport.RemoteCommandFailure,
+	}
+}
+
+// Continue does nothing; deniedExec never places anything in a cgroup.
+func (d *deniedExec) Continue() {}
+
+// PID returns an invalid PID; deniedExec never starts a process.
+func (d *deniedExec) PID() int {
+	return 0
+}
+
+// emitExecDeniedAuditEvent records that a command was refused before it
+// ever ran, including the ID of the rule that matched.
+func emitExecDeniedAuditEvent(ctx *ServerContext, cmd string, denyErr error) {
+	auditLog := ctx.srv.GetAuditLog()
+	if auditLog == nil {
+		log.Warnf("No audit log")
+		return
+	}
+
+	fields := events.EventFields{
+		events.EventUser:        ctx.Identity.TeleportUser,
+		events.EventLogin:       ctx.Identity.Login,
+		events.LocalAddr:        ctx.Conn.LocalAddr().String(),
+		events.RemoteAddr:       ctx.Conn.RemoteAddr().String(),
+		events.EventNamespace:   ctx.srv.GetNamespace(),
+		events.ExecEventCommand: cmd,
+	}
+	if denied, ok := denyErr.(*execDeniedError); ok {
+		fields[events.ExecDeniedRule] = denied.ruleID
+		fields[events.ExecDeniedReason] = denied.reason
+	} else if denyErr != nil {
+		fields[events.ExecDeniedReason] = denyErr.Error()
+	}
+
+	auditLog.EmitAuditEvent(events.ExecDenied, fields)
+}
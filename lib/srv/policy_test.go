@@ -0,0 +1,91 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package srv
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGlobInterceptorInspect(t *testing.T) {
+	tests := []struct {
+		desc   string
+		rules  []ExecRule
+		cmd    string
+		wantOK bool
+	}{
+		{
+			desc:   "no rules is default-allow",
+			rules:  nil,
+			cmd:    "rm -rf /",
+			wantOK: true,
+		},
+		{
+			desc:   "deny-only rules are still default-allow for everything else",
+			rules:  []ExecRule{{ID: "no-rm-rf-root", Deny: "rm", ArgvRegex: regexp.MustCompile(`rm\s+-rf\s+/($|\s)`)}},
+			cmd:    "ls -la",
+			wantOK: true,
+		},
+		{
+			desc:   "deny-only rules still deny the matched glob",
+			rules:  []ExecRule{{ID: "no-rm", Deny: "rm"}},
+			cmd:    "rm -rf /tmp/foo",
+			wantOK: false,
+		},
+		{
+			desc:   "deny-only rules still deny the matched argv pattern",
+			rules:  []ExecRule{{ID: "no-rm-rf-root", ArgvRegex: regexp.MustCompile(`rm\s+-rf\s+/($|\s)`)}},
+			cmd:    "rm -rf /",
+			wantOK: false,
+		},
+		{
+			desc:   "allow rule lets the matching command through",
+			rules:  []ExecRule{{ID: "git-only", Allow: "git*"}},
+			cmd:    "git-upload-pack /repo",
+			wantOK: true,
+		},
+		{
+			desc:   "allow rule denies anything not matching",
+			rules:  []ExecRule{{ID: "git-only", Allow: "git*"}},
+			cmd:    "bash -c id",
+			wantOK: false,
+		},
+		{
+			desc:   "deny wins over allow for the same command",
+			rules:  []ExecRule{{ID: "allow-all", Allow: "*"}, {ID: "no-rm", Deny: "rm"}},
+			cmd:    "rm -rf /",
+			wantOK: false,
+		},
+		{
+			desc:   "unparsable command line is denied",
+			rules:  []ExecRule{{ID: "git-only", Allow: "git*"}},
+			cmd:    `git "unterminated`,
+			wantOK: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			g := &globInterceptor{rules: tt.rules}
+			_, decision, _ := g.Inspect(nil, tt.cmd)
+			gotOK := decision == DecisionAllow
+			if gotOK != tt.wantOK {
+				t.Errorf("Inspect(%q) decision = %v, want allow=%v", tt.cmd, decision, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,481 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package srv
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/gravitational/teleport/lib/events"
+
+	"github.com/gravitational/trace"
+)
+
+// sftpExec handles the "sftp" subsystem request. Unlike SCP, which is
+// bolted onto a regular exec by rewriting the command line (see
+// transformSecureCopy), SFTP is serviced by an in-process SFTP server
+// running inside the re-exec'd Teleport child, under the login user's
+// uid/gid and PAM session, exactly like any other exec request. This
+// keeps file transfer inside Teleport's normal audited, privilege-dropped
+// execution path instead of shelling out to the legacy scp binary.
+type sftpExec struct {
+	// Ctx holds the *ServerContext.
+	Ctx *ServerContext
+
+	// command is the re-exec'd command line used to launch the SFTP child.
+	command string
+
+	// Cmd holds the re-exec'd child process hosting the SFTP server.
+	Cmd *exec.Cmd
+
+	// resourceAccountant places the re-exec'd child in a per-session cgroup
+	// and reports its resource usage once the session ends, the same as
+	// localExec.resourceAccountant.
+	resourceAccountant cgroupAccountant
+
+	// teardownCancel stops the goroutine watching s.Ctx.Context() for
+	// cancellation once the SFTP child has exited on its own, the same as
+	// localExec.teardownCancel.
+	teardownCancel context.CancelFunc
+
+	// mu guards processExited and clientDisconnected below, the same as
+	// localExec.mu: killOnCancel and Wait touch both from different
+	// goroutines.
+	mu sync.Mutex
+
+	// processExited records that Cmd.Wait has returned, the same as
+	// localExec.processExited.
+	processExited bool
+
+	// clientDisconnected is set by the teardown watcher if it had to signal
+	// the child because s.Ctx.Context() was canceled mid-transfer, rather
+	// than the child exiting on its own, the same as
+	// localExec.clientDisconnected.
+	clientDisconnected bool
+}
+
+// GetCommand returns the command string.
+func (s *sftpExec) GetCommand() string {
+	return s.command
+}
+
+// SetCommand sets the command string.
+func (s *sftpExec) SetCommand(command string) {
+	s.command = command
+}
+
+// Start launches the re-exec'd Teleport child that will host the in-process
+// SFTP server and wires its stdio to the SSH channel.
+func (s *sftpExec) Start(channel ssh.Channel) (*ExecResult, error) {
+	teleportBin, err := os.Executable()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// Re-exec Teleport with the sftp subcommand, just like transformSecureCopy
+	// does for scp. The child decodes the rest of its context (identity,
+	// login, audit sink) the same way any other re-exec'd exec command does.
+	s.command = fmt.Sprintf("%s sftp --remote-addr=%s --local-addr=%s",
+		teleportBin,
+		s.Ctx.Conn.RemoteAddr().String(),
+		s.Ctx.Conn.LocalAddr().String())
+
+	s.Cmd, err = ConfigureCommand(s.Ctx)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// Place the SFTP child in the same per-session accounting cgroup a
+	// regular exec would get, so a file transfer is subject to the same
+	// per-role resource limits instead of running unaccounted for. See
+	// localExec.Start for why this happens before Cmd.Start.
+	sessionID := hex.EncodeToString(s.Ctx.Conn.SessionID())
+	s.resourceAccountant = newCgroupAccountant(sessionID, cgroupParentDefault, resolveResourceLimits(s.Ctx))
+	if cgroupPath := s.resourceAccountant.Path(); cgroupPath != "" {
+		if cgroupFile, err := os.Open(cgroupPath); err == nil {
+			if s.Cmd.SysProcAttr == nil {
+				s.Cmd.SysProcAttr = &syscall.SysProcAttr{}
+			}
+			s.Cmd.SysProcAttr.UseCgroupFD = true
+			s.Cmd.SysProcAttr.CgroupFD = int(cgroupFile.Fd())
+			defer cgroupFile.Close()
+		}
+	}
+
+	s.Cmd.Stderr = channel.Stderr()
+	s.Cmd.Stdout = channel
+
+	inputWriter, err := s.Cmd.StdinPipe()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	go func() {
+		io.Copy(inputWriter, channel)
+		inputWriter.Close()
+	}()
+
+	if err := s.Cmd.Start(); err != nil {
+		s.Ctx.Warningf("SFTP subsystem failed to start: %v", err)
+		s.resourceAccountant.Cleanup()
+		emitExecAuditEvent(s.Ctx, s.GetCommand(), err, terminationExited, "", nil)
+		return &ExecResult{
+			Command: s.GetCommand(),
+			Code:    exitCode(err),
+		}, trace.ConvertSystemError(err)
+	}
+
+	// Cgroup v1 (unlike v2) has no equivalent to CgroupFD, so join it after
+	// the fact instead of at clone time.
+	if v1, ok := s.resourceAccountant.(*cgroupV1Accountant); ok {
+		v1.Join(s.Cmd.Process.Pid)
+	}
+
+	// Watch for the session context being canceled (client disconnect or
+	// server shutdown) so a client that vanishes mid-transfer doesn't pin
+	// this SFTP session forever, the same as localExec.killOnCancel.
+	teardownCtx, teardownCancel := context.WithCancel(s.Ctx.Context())
+	s.teardownCancel = teardownCancel
+	go s.killOnCancel(teardownCtx)
+
+	s.Ctx.Infof("Started SFTP subsystem for %v", s.Ctx.Identity.Login)
+
+	return nil, nil
+}
+
+// killOnCancel waits for ctx to be done and, if the SFTP child hasn't
+// already exited on its own, sends SIGTERM followed by SIGKILL on a grace
+// deadline. See localExec.killOnCancel, which this mirrors.
+func (s *sftpExec) killOnCancel(ctx context.Context) {
+	<-ctx.Done()
+
+	s.mu.Lock()
+	if s.processExited {
+		s.mu.Unlock()
+		return
+	}
+	s.clientDisconnected = true
+	s.mu.Unlock()
+
+	proc := s.Cmd.Process
+	if proc == nil {
+		return
+	}
+
+	s.Ctx.Warningf("Session context canceled, sending SIGTERM to pid %v.", proc.Pid)
+	proc.Signal(syscall.SIGTERM)
+
+	select {
+	case <-time.After(teardownGracePeriod):
+	case <-s.Ctx.Context().Done():
+		<-time.After(teardownGracePeriod)
+	}
+
+	s.mu.Lock()
+	exited := s.processExited
+	s.mu.Unlock()
+	if !exited {
+		s.Ctx.Warningf("Pid %v did not exit after SIGTERM, sending SIGKILL.", proc.Pid)
+		proc.Signal(syscall.SIGKILL)
+	}
+}
+
+// Wait will block while the SFTP server child executes.
+func (s *sftpExec) Wait() *ExecResult {
+	if s.Cmd.Process == nil {
+		s.Ctx.Errorf("no process")
+	}
+
+	err := s.Cmd.Wait()
+
+	// Record that Cmd.Wait has returned before killOnCancel can observe
+	// s.Cmd.ProcessState, and snapshot clientDisconnected under the same
+	// lock it's written under.
+	s.mu.Lock()
+	s.processExited = true
+	clientDisconnected := s.clientDisconnected
+	s.mu.Unlock()
+
+	// Stop the teardown watcher now that the child has exited on its own;
+	// if it already fired (client_disconnect), this is a no-op.
+	if s.teardownCancel != nil {
+		s.teardownCancel()
+	}
+
+	if err != nil {
+		s.Ctx.Debugf("SFTP subsystem failed: %v.", err)
+	} else {
+		s.Ctx.Debugf("SFTP subsystem exited successfully.")
+	}
+
+	signal := signalFromError(err)
+	reason := terminationReason(s.Ctx, clientDisconnected, signal)
+
+	// Read back resource usage before the cgroup is cleaned up, same as
+	// localExec.Wait.
+	usage, usageErr := s.resourceAccountant.Usage()
+	s.resourceAccountant.Cleanup()
+	if usageErr != nil {
+		s.Ctx.Debugf("Unable to read resource usage: %v.", usageErr)
+	} else {
+		labels := prometheus.Labels{"login": s.Ctx.Identity.Login, "role": roleNamesLabel(s.Ctx)}
+		execCPUSeconds.With(labels).Add(usage.CPUSeconds)
+		execMemoryPeakBytes.With(labels).Observe(float64(usage.MemoryPeakBytes))
+		if usage.OOMKills > 0 {
+			execOOMKillsTotal.With(labels).Add(float64(usage.OOMKills))
+		}
+	}
+
+	emitExecAuditEvent(s.Ctx, s.GetCommand(), err, reason, signal, &usage)
+
+	execResult := &ExecResult{
+		Command: s.GetCommand(),
+		Code:    exitCode(err),
+		Signal:  signal,
+	}
+	if clientDisconnected {
+		execResult.Code = MagicSessionErrorCode
+	}
+
+	return execResult
+}
+
+// Continue will resume execution of the SFTP child after it completes its
+// pre-processing routine (placed in a cgroup), same as localExec.Continue.
+func (s *sftpExec) Continue() {
+	s.Ctx.contw.Close()
+	s.Ctx.contw = nil
+}
+
+// PID returns the PID of the Teleport process that was re-execed.
+func (s *sftpExec) PID() int {
+	return s.Cmd.Process.Pid
+}
+
+// sftpAuditHandlers wraps an *sftp.Handlers-compatible filesystem rooted at
+// homeDir, emitting an SFTP.* audit event for every Open/Write/Rename/Remove
+// so the audit log records per-operation detail instead of a single opaque
+// "ran sftp" line.
+type sftpAuditHandlers struct {
+	ctx     *ServerContext
+	homeDir string
+}
+
+// newSFTPHandlers builds the sftp.Handlers used by the re-exec'd SFTP child
+// to serve requests rooted at the login user's home directory.
+func newSFTPHandlers(ctx *ServerContext, homeDir string) sftp.Handlers {
+	h := &sftpAuditHandlers{ctx: ctx, homeDir: homeDir}
+	return sftp.Handlers{
+		FileGet:  h,
+		FilePut:  h,
+		FileCmd:  h,
+		FileList: h,
+	}
+}
+
+// RunSFTP runs the in-process SFTP server that services a single "teleport
+// sftp" re-exec'd child, speaking the protocol over rwc (the child's stdio,
+// wired to the SSH channel by sftpExec.Start/Wait in the parent process) and
+// serving requests rooted at homeDir. It's called from the "sftp" subcommand
+// the child re-execs into, which is where the login user's uid/gid and PAM
+// session actually get dropped into, so the Open/Write/Rename/Remove audit
+// events this package emits are attributed to that privilege-dropped
+// process rather than the Teleport service itself.
+func RunSFTP(ctx *ServerContext, homeDir string, rwc io.ReadWriteCloser) error {
+	server := sftp.NewRequestServer(rwc, newSFTPHandlers(ctx, homeDir))
+	defer server.Close()
+	return trace.Wrap(server.Serve())
+}
+
+// resolve joins a relative SFTP path against the handlers' home directory.
+// Absolute paths are returned unchanged, so they are not confined to the
+// home directory.
+func (h *sftpAuditHandlers) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(h.homeDir, path)
+}
+
+// Fileread services SFTP read (download) requests.
+func (h *sftpAuditHandlers) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := os.Open(h.resolve(r.Filepath))
+	h.emit(events.SFTPOpen, r.Filepath, nil, err)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	return f, nil
+}
+
+// Filewrite services SFTP write (upload) requests.
+func (h *sftpAuditHandlers) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	f, err := os.OpenFile(h.resolve(r.Filepath), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	h.emit(events.SFTPWrite, r.Filepath, nil, err)
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	return f, nil
+}
+
+// Filecmd services SFTP Rename/Remove/Mkdir/Rmdir requests. Any other method
+// (Symlink, Setstat, ...) is answered as unsupported.
+func (h *sftpAuditHandlers) Filecmd(r *sftp.Request) error {
+	var err error
+	switch r.Method {
+	case "Rename":
+		// Stat before the rename: once it succeeds, the file no longer
+		// exists at Filepath for h.resolve to stat.
+		info, _ := os.Stat(h.resolve(r.Filepath))
+		err = os.Rename(h.resolve(r.Filepath), h.resolve(r.Target))
+		h.emitRename(r.Filepath, r.Target, info, err)
+	case "Remove":
+		// Stat before the removal: os.Remove deletes the file, so stating
+		// it afterwards in emit would always miss.
+		info, _ := os.Stat(h.resolve(r.Filepath))
+		err = os.Remove(h.resolve(r.Filepath))
+		h.emit(events.SFTPRemove, r.Filepath, info, err)
+	case "Mkdir":
+		err = os.Mkdir(h.resolve(r.Filepath), 0755)
+		h.emit(events.SFTPMkdir, r.Filepath, nil, err)
+	case "Rmdir":
+		info, _ := os.Stat(h.resolve(r.Filepath))
+		err = os.Remove(h.resolve(r.Filepath))
+		h.emit(events.SFTPRmdir, r.Filepath, info, err)
+	default:
+		return sftp.ErrSshFxOpUnsupported
+	}
+	if err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	return nil
+}
+
+// Filelist services SFTP directory listing and stat requests.
+func (h *sftpAuditHandlers) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		entries, err := os.ReadDir(h.resolve(r.Filepath))
+		if err != nil {
+			return nil, trace.ConvertSystemError(err)
+		}
+		infos := make([]os.FileInfo, 0, len(entries))
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			infos = append(infos, info)
+		}
+		return listerAt(infos), nil
+	case "Stat", "Lstat":
+		info, err := os.Stat(h.resolve(r.Filepath))
+		if err != nil {
+			return nil, trace.ConvertSystemError(err)
+		}
+		return listerAt([]os.FileInfo{info}), nil
+	default:
+		return nil, sftp.ErrSshFxOpUnsupported
+	}
+}
+
+// listerAt adapts a slice of os.FileInfo to sftp.ListerAt.
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// emit records an Open/Write/Remove/Mkdir/Rmdir audit event for a single
+// SFTP operation, including the file size when available. info is the
+// file's stat result, supplied by the caller when the operation removes the
+// path (so it must be captured before the op runs); if nil, emit stats the
+// path itself, which is only valid when the path still exists afterwards.
+func (h *sftpAuditHandlers) emit(eventType events.Event, path string, info os.FileInfo, opErr error) {
+	auditLog := h.ctx.srv.GetAuditLog()
+	if auditLog == nil {
+		return
+	}
+
+	fields := events.EventFields{
+		events.EventUser:  h.ctx.Identity.TeleportUser,
+		events.EventLogin: h.ctx.Identity.Login,
+		events.SFTPPath:   path,
+	}
+	if info == nil {
+		info, _ = os.Stat(h.resolve(path))
+	}
+	if info != nil {
+		fields[events.SFTPSize] = info.Size()
+		fields[events.SFTPMode] = info.Mode().String()
+	}
+	if opErr != nil {
+		fields[events.SFTPResult] = "error"
+		fields[events.ExecEventError] = opErr.Error()
+	} else {
+		fields[events.SFTPResult] = "success"
+	}
+
+	auditLog.EmitAuditEvent(eventType, fields)
+}
+
+// emitRename records an SFTP.Rename audit event with both the source and
+// destination paths. info is the source file's stat result, captured by the
+// caller before the rename ran, since src no longer resolves to anything
+// once the rename succeeds.
+func (h *sftpAuditHandlers) emitRename(src, dst string, info os.FileInfo, opErr error) {
+	auditLog := h.ctx.srv.GetAuditLog()
+	if auditLog == nil {
+		return
+	}
+
+	fields := events.EventFields{
+		events.EventUser:  h.ctx.Identity.TeleportUser,
+		events.EventLogin: h.ctx.Identity.Login,
+		events.SFTPPath:   src,
+		events.SFTPTarget: dst,
+	}
+	if info != nil {
+		fields[events.SFTPSize] = info.Size()
+		fields[events.SFTPMode] = info.Mode().String()
+	}
+	if opErr != nil {
+		fields[events.SFTPResult] = "error"
+		fields[events.ExecEventError] = opErr.Error()
+	} else {
+		fields[events.SFTPResult] = "success"
+	}
+
+	auditLog.EmitAuditEvent(events.SFTPRename, fields)
+}